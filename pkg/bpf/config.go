@@ -0,0 +1,139 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"strings"
+	"time"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+// Config holds the process-wide settings that control how Kmesh's userspace
+// control plane talks to the bpf data plane and to istiod.
+type Config struct {
+	// Mode selects which xDS surface the controller subscribes to, e.g.
+	// constants.AdsMode or constants.WorkloadMode.
+	Mode string
+
+	// DiscoveryAddress is the istiod address the xDS client dials. Multiple
+	// endpoints can be given as a comma-separated list, e.g.
+	// "istiod-1:15012,istiod-2:15012"; see Addresses.
+	DiscoveryAddress string
+
+	// XdsStickyPreferred keeps the xDS client pinned to whichever discovery
+	// endpoint it last connected to successfully, instead of spreading
+	// requests round-robin across all of them. Switching istiods forces a
+	// full config resync, so this matters more for xDS than for typical
+	// gRPC traffic.
+	XdsStickyPreferred bool
+
+	// EnableBpf toggles whether the bpf maps/programs backing the control
+	// plane are actually loaded. Disabled in most unit tests.
+	EnableBpf bool
+
+	// XdsRetryInitialBackoff is the delay before the second dial after a
+	// failed xDS connection attempt, and the wait before reconnecting after
+	// a stream error that asks the client to slow down. Other stream errors
+	// reconnect without waiting first.
+	XdsRetryInitialBackoff time.Duration
+	// XdsRetryMaxBackoff caps the backoff computed between reconnect
+	// attempts, no matter how many have already failed. XdsRetryJitter is
+	// applied on top of it, so an actual wait can exceed it by up to that
+	// fraction.
+	XdsRetryMaxBackoff time.Duration
+	// XdsRetryMultiplier is applied to the previous backoff on each
+	// successive failure, until XdsRetryMaxBackoff is reached.
+	XdsRetryMultiplier float64
+	// XdsRetryMaxElapsedTime bounds the total time spent retrying before
+	// recoverConnection gives up and returns an error. Zero means retry
+	// forever.
+	XdsRetryMaxElapsedTime time.Duration
+	// XdsRetryJitter is the fraction of the computed backoff (0..1) that is
+	// added or subtracted at random, to avoid a thundering herd of clients
+	// reconnecting to istiod in lockstep.
+	XdsRetryJitter float64
+
+	// XdsKeepaliveInterval is how often the xDS client pings istiod on an
+	// idle HTTP/2 connection to detect half-open connections (NAT
+	// timeouts, silent istiod restarts) without waiting for the next
+	// DiscoveryRequest.
+	XdsKeepaliveInterval time.Duration
+	// XdsKeepaliveTimeout is how long the xDS client waits for a keepalive
+	// ping ack before considering the connection dead.
+	XdsKeepaliveTimeout time.Duration
+
+	// XdsTLSMode selects how the xDS client authenticates to istiod: one of
+	// constants.TLSModeInsecure, constants.TLSModeStatic or
+	// constants.TLSModeSpiffe.
+	XdsTLSMode string
+	// XdsTLSCertFile, XdsTLSKeyFile and XdsTLSCAFile are the client
+	// certificate, private key and CA bundle used in TLSModeStatic.
+	XdsTLSCertFile string
+	XdsTLSKeyFile  string
+	XdsTLSCAFile   string
+	// XdsTLSServerName overrides the server name used for TLS verification,
+	// e.g. when the discovery address is an IP.
+	XdsTLSServerName string
+	// XdsSpiffeWorkloadAPIAddr is the SPIFFE Workload API socket used in
+	// TLSModeSpiffe, e.g. "unix:///run/spire/sockets/agent.sock".
+	XdsSpiffeWorkloadAPIAddr string
+	// XdsSpiffeTrustDomain restricts which peer SPIFFE IDs are authorized
+	// in TLSModeSpiffe, e.g. "cluster.local".
+	XdsSpiffeTrustDomain string
+}
+
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Mode:             constants.AdsMode,
+		DiscoveryAddress: constants.DefaultDiscoveryAddress,
+		EnableBpf:        false,
+
+		XdsRetryInitialBackoff: 200 * time.Millisecond,
+		XdsRetryMaxBackoff:     30 * time.Second,
+		XdsRetryMultiplier:     1.6,
+		XdsRetryMaxElapsedTime: 0,
+		XdsRetryJitter:         0.2,
+
+		XdsKeepaliveInterval: 30 * time.Second,
+		XdsKeepaliveTimeout:  10 * time.Second,
+
+		XdsTLSMode: constants.TLSModeInsecure,
+	}
+}
+
+// GetConfig returns the process-wide bpf/xds configuration.
+func GetConfig() *Config {
+	return config
+}
+
+// Addresses splits DiscoveryAddress on "," and trims whitespace around each
+// entry, so operators can configure one or several istiod endpoints with a
+// single flag/env var.
+func (c *Config) Addresses() []string {
+	parts := strings.Split(c.DiscoveryAddress, ",")
+	addrs := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			addrs = append(addrs, p)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package constants
+
+const (
+	// AdsMode drives the kernel native programs through istiod's ADS xDS APIs.
+	AdsMode = "ads"
+	// WorkloadMode drives the dual-engine mode through istiod's workload xDS APIs.
+	WorkloadMode = "workload"
+)
+
+const (
+	// DefaultDiscoveryAddress is used when no discovery address is configured.
+	DefaultDiscoveryAddress = "istiod.istio-system.svc:15012"
+)
+
+const (
+	// TLSModeInsecure dials istiod without transport security.
+	TLSModeInsecure = "insecure"
+	// TLSModeStatic dials istiod with mTLS sourced from a fixed cert/key/CA
+	// file triple on disk.
+	TLSModeStatic = "static"
+	// TLSModeSpiffe dials istiod with mTLS sourced from a SPIFFE Workload
+	// API, e.g. a SPIRE agent, which rotates certs automatically.
+	TLSModeSpiffe = "spiffe"
+)
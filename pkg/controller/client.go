@@ -0,0 +1,372 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package controller owns the xDS client lifecycle: connecting to istiod,
+// keeping the ADS/workload streams alive, and reconnecting when they fail.
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+
+	"kmesh.net/kmesh/pkg/bpf"
+	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/controller/envoy"
+	"kmesh.net/kmesh/pkg/controller/workload"
+	"kmesh.net/kmesh/pkg/controller/xdserr"
+	"kmesh.net/kmesh/pkg/logger"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+var log = logger.NewLoggerScope("controller")
+
+// multiResolverScheme is the (ClientConn-scoped) scheme XdsClient registers
+// its nets.StaticResolver under when it has more than one discovery
+// endpoint to balance across.
+const multiResolverScheme = "kmesh-xds"
+
+// bpfConfig is the process-wide config consulted for the xDS mode and
+// connection/retry tuning. Tests swap it out to drive specific code paths.
+var bpfConfig = bpf.GetConfig()
+
+// RetryConfig controls the exponential backoff used while reconnecting to
+// istiod, modeled on the retry helpers used by OTLP exporters and etcd's
+// clientv3.
+type RetryConfig struct {
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the backoff between retries before Jitter is applied.
+	MaxBackoff time.Duration
+	// Multiplier is applied to the previous backoff on each failure.
+	Multiplier float64
+	// MaxElapsedTime bounds the total retry budget. Zero means retry
+	// forever.
+	MaxElapsedTime time.Duration
+	// Jitter is the fraction (0..1) of randomness applied to each computed
+	// backoff, to avoid a thundering herd of clients reconnecting in
+	// lockstep.
+	Jitter float64
+}
+
+func retryConfigFromBpf(cfg *bpf.Config) RetryConfig {
+	return RetryConfig{
+		InitialBackoff: cfg.XdsRetryInitialBackoff,
+		MaxBackoff:     cfg.XdsRetryMaxBackoff,
+		Multiplier:     cfg.XdsRetryMultiplier,
+		MaxElapsedTime: cfg.XdsRetryMaxElapsedTime,
+		Jitter:         cfg.XdsRetryJitter,
+	}
+}
+
+// XdsClient owns the connection to istiod and the ADS or workload stream
+// built on top of it, reconnecting with backoff whenever either fails.
+type XdsClient struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	conn           *grpc.ClientConn
+	xdsResolver    *nets.StaticResolver
+	AdsStream      *envoy.AdsStream
+	workloadStream *workload.WorkloadStream
+
+	// addresses is the discovery endpoint set this client balances across.
+	// A single address is dialed directly; more than one goes through
+	// nets.GrpcConnectMulti so gRPC's round_robin/pick_first balancer can
+	// fail over between them.
+	addresses       []string
+	stickyPreferred bool
+
+	// credProvider supplies the transport credentials used for every dial;
+	// see XdsCredentialProvider.
+	credProvider XdsCredentialProvider
+
+	RetryConfig RetryConfig
+
+	// sleep and randFloat are overridden in tests to inject a fake clock so
+	// backoff doesn't slow the suite down.
+	sleep     func(time.Duration)
+	randFloat func() float64
+}
+
+// NewXdsClient builds an XdsClient ready to connect, with its retry policy
+// and discovery endpoints taken from the current bpf.Config.
+func NewXdsClient() *XdsClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &XdsClient{
+		ctx:             ctx,
+		cancel:          cancel,
+		addresses:       bpfConfig.Addresses(),
+		stickyPreferred: bpfConfig.XdsStickyPreferred,
+		credProvider:    credentialProviderFromConfig(ctx, bpfConfig),
+		RetryConfig:     retryConfigFromBpf(bpfConfig),
+		sleep:           time.Sleep,
+		randFloat:       rand.Float64,
+	}
+}
+
+// recoverConnection dials istiod, retrying with exponential backoff and
+// jitter until it succeeds or the retry budget (if any) is exhausted. It is
+// only used for the single-endpoint case; with several discovery endpoints
+// configured, gRPC's balancer owns failover instead (see waitForHealthyConn).
+func (c *XdsClient) recoverConnection() error {
+	address := bpfConfig.DiscoveryAddress
+	if len(c.addresses) > 0 {
+		address = c.addresses[0]
+	}
+	backoff := c.RetryConfig.InitialBackoff
+	start := time.Now()
+
+	for {
+		conn, err := c.dial(address)
+		if err == nil {
+			if c.conn != nil {
+				c.conn.Close()
+			}
+			c.conn = conn
+			return nil
+		}
+
+		if c.RetryConfig.MaxElapsedTime > 0 && time.Since(start) > c.RetryConfig.MaxElapsedTime {
+			return fmt.Errorf("giving up connecting to xds server %s after %s: %w", address, c.RetryConfig.MaxElapsedTime, err)
+		}
+
+		wait := jitter(backoff, c.RetryConfig.Jitter, c.randFloat)
+		log.Warnf("failed to connect to xds server %s, retrying in %s: %v", address, wait, err)
+		c.sleep(wait)
+		backoff = nextBackoff(backoff, c.RetryConfig)
+	}
+}
+
+// dial resolves the current transport credentials and connects to address.
+func (c *XdsClient) dial(address string) (*grpc.ClientConn, error) {
+	creds, err := c.credProvider.TransportCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("resolving xds transport credentials: %w", err)
+	}
+	return nets.GrpcConnect(address, creds)
+}
+
+// dialMulti opens the balanced connection across all configured discovery
+// endpoints. It only needs to run once: after that, the balancer moves to a
+// different subconn while waitForHealthyConn waits for it, with no redial.
+func (c *XdsClient) dialMulti() error {
+	creds, err := c.credProvider.TransportCredentials()
+	if err != nil {
+		return fmt.Errorf("resolving xds transport credentials: %w", err)
+	}
+
+	policy := "round_robin"
+	if c.stickyPreferred {
+		policy = "pick_first"
+	}
+	conn, res, err := nets.GrpcConnectMulti(multiResolverScheme, c.addresses, policy, creds)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.xdsResolver = res
+	return nil
+}
+
+// waitForHealthyConn blocks until the balanced connection has at least one
+// ready subconn. It only sleeps/backs off once every endpoint has landed in
+// TRANSIENT_FAILURE together; as long as any subconn is still connecting or
+// ready, it just waits for the next state change and lets the balancer do
+// its job of moving on to the next healthy endpoint.
+//
+// Idle is not treated as healthy: it's the state a freshly dialed
+// ClientConn starts in before any connection attempt has been made, so
+// hitting it kicks off a Connect() instead of returning success. Shutdown
+// is treated as a terminal error rather than falling through to the
+// no-sleep WaitForStateChange branch -- once c.conn is closed (e.g.
+// concurrently by Close) its state can never change again, and waiting on
+// an already-cancelled c.ctx returns immediately, so failing to special-case
+// it here would busy-loop.
+func (c *XdsClient) waitForHealthyConn() error {
+	backoff := c.RetryConfig.InitialBackoff
+	start := time.Now()
+
+	state := c.conn.GetState()
+	for state != connectivity.Ready {
+		switch state {
+		case connectivity.Shutdown:
+			return fmt.Errorf("xds connection to %v was closed while waiting for it to become healthy", c.addresses)
+		case connectivity.Idle:
+			c.conn.Connect()
+		case connectivity.TransientFailure:
+			if c.RetryConfig.MaxElapsedTime > 0 && time.Since(start) > c.RetryConfig.MaxElapsedTime {
+				return fmt.Errorf("giving up on all xds discovery endpoints %v after %s", c.addresses, c.RetryConfig.MaxElapsedTime)
+			}
+			wait := jitter(backoff, c.RetryConfig.Jitter, c.randFloat)
+			log.Warnf("all xds discovery endpoints %v are unavailable, retrying in %s", c.addresses, wait)
+			c.sleep(wait)
+			backoff = nextBackoff(backoff, c.RetryConfig)
+		}
+		c.conn.WaitForStateChange(c.ctx, state)
+		state = c.conn.GetState()
+	}
+	return nil
+}
+
+// nextBackoff grows prev by the configured multiplier, capped at MaxBackoff.
+func nextBackoff(prev time.Duration, cfg RetryConfig) time.Duration {
+	if prev <= 0 {
+		prev = cfg.InitialBackoff
+	}
+	next := time.Duration(float64(prev) * cfg.Multiplier)
+	if next > cfg.MaxBackoff {
+		next = cfg.MaxBackoff
+	}
+	return next
+}
+
+// jitter randomizes d by +/- frac, using randFloat (expected to return a
+// value in [0, 1)) as the source of randomness.
+func jitter(d time.Duration, frac float64, randFloat func() float64) time.Duration {
+	if frac <= 0 || randFloat == nil {
+		return d
+	}
+	delta := (randFloat()*2 - 1) * frac
+	return time.Duration(float64(d) * (1 + delta))
+}
+
+// createGrpcStreamClient (re)connects to istiod and opens the ADS or
+// workload stream for the currently configured mode.
+func (c *XdsClient) createGrpcStreamClient() error {
+	if len(c.addresses) > 1 {
+		if c.conn == nil {
+			if err := c.dialMulti(); err != nil {
+				return err
+			}
+		}
+		if err := c.waitForHealthyConn(); err != nil {
+			return err
+		}
+	} else if err := c.recoverConnection(); err != nil {
+		return err
+	}
+
+	return c.openStream()
+}
+
+// openStream (re)creates the ADS or workload stream on the client's current
+// connection, without touching the connection itself. It is split out from
+// createGrpcStreamClient so handleUpstream can restart just the stream on a
+// xdserr.RestartStream classification, instead of paying for a full
+// reconnect.
+func (c *XdsClient) openStream() error {
+	switch bpfConfig.Mode {
+	case constants.WorkloadMode:
+		stream, err := workload.NewWorkloadStream(c.conn)
+		if err != nil {
+			return err
+		}
+		c.workloadStream = stream
+	default:
+		stream, err := envoy.NewAdsStream(c.conn)
+		if err != nil {
+			return err
+		}
+		c.AdsStream = stream
+	}
+	return nil
+}
+
+// streamType returns the stream_type label used on xdserr metrics for the
+// currently configured mode.
+func streamType() string {
+	if bpfConfig.Mode == constants.WorkloadMode {
+		return constants.WorkloadMode
+	}
+	return constants.AdsMode
+}
+
+// handleUpstream runs the ADS or workload stream until it fails terminally
+// or ctx is cancelled, reconnecting on every recoverable error. What
+// "reconnecting" means depends on how xdserr.Classify judged the error: a
+// plain retry or backoff-then-retry goes through createGrpcStreamClient
+// (a redial with one discovery endpoint, a wait for the balanced connection
+// to be healthy with several), while RestartStream reopens the stream on
+// the connection already in place.
+func (c *XdsClient) handleUpstream(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		var err error
+		switch bpfConfig.Mode {
+		case constants.WorkloadMode:
+			err = c.workloadStream.HandleWorkloadStream()
+		default:
+			err = c.AdsStream.HandleAdsStream()
+		}
+		if err == nil {
+			continue
+		}
+
+		code, action := xdserr.Classify(err)
+		xdserr.RecordClassification(streamType(), code, action)
+
+		if action == xdserr.Fatal {
+			log.Errorf("xds stream failed with a terminal error, giving up: %v", err)
+			return
+		}
+
+		if action == xdserr.RestartStream {
+			log.Warnf("xds stream hit a recoverable protocol error, restarting stream: %v", err)
+			if err := c.openStream(); err != nil {
+				log.Errorf("failed to restart xds stream, will fall back to a full reconnect: %v", err)
+			} else {
+				continue
+			}
+		}
+
+		if action == xdserr.RetryAfterBackoff {
+			wait := jitter(c.RetryConfig.InitialBackoff, c.RetryConfig.Jitter, c.randFloat)
+			log.Warnf("xds server asked us to slow down, waiting %s before reconnecting: %v", wait, err)
+			c.sleep(wait)
+		}
+
+		start := time.Now()
+		if err := c.createGrpcStreamClient(); err != nil {
+			log.Errorf("failed to recover xds stream, will keep retrying: %v", err)
+			continue
+		}
+		xdserr.ObserveReconnect(streamType(), time.Since(start))
+	}
+}
+
+// Close tears down the xDS client's connection, cancels its context, and
+// releases any resources (e.g. a SPIFFE Workload API stream) held by its
+// credential provider.
+func (c *XdsClient) Close() {
+	c.cancel()
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	if closer, ok := c.credProvider.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
@@ -19,19 +19,28 @@ package controller
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
 	"gotest.tools/assert"
 
 	"kmesh.net/kmesh/pkg/bpf"
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller/envoy"
 	"kmesh.net/kmesh/pkg/controller/workload"
+	"kmesh.net/kmesh/pkg/controller/xdserr"
 	"kmesh.net/kmesh/pkg/controller/xdstest"
 	"kmesh.net/kmesh/pkg/nets"
 )
@@ -39,12 +48,16 @@ import (
 func TestRecoverConnection(t *testing.T) {
 	t.Run("test reconnect success", func(t *testing.T) {
 		utClient := NewXdsClient()
+		// Inject a fake clock so the exponential backoff between the two
+		// simulated connect failures below doesn't slow this test down.
+		utClient.sleep = func(time.Duration) {}
+		utClient.randFloat = func() float64 { return 0.5 }
 		patches := gomonkey.NewPatches()
 		defer patches.Reset()
 		iteration := 0
 		netPatches := gomonkey.NewPatches()
 		defer netPatches.Reset()
-		netPatches.ApplyFunc(nets.GrpcConnect, func(addr string) (*grpc.ClientConn, error) {
+		netPatches.ApplyFunc(nets.GrpcConnect, func(addr string, _ credentials.TransportCredentials) (*grpc.ClientConn, error) {
 			// // more than 2 link failures will result in a long test time
 			if iteration < 2 {
 				iteration++
@@ -73,7 +86,7 @@ func TestClientResponseProcess(t *testing.T) {
 	t.Run("ads stream process failed, test reconnect", func(t *testing.T) {
 		netPatches := gomonkey.NewPatches()
 		defer netPatches.Reset()
-		netPatches.ApplyFunc(nets.GrpcConnect, func(addr string) (*grpc.ClientConn, error) {
+		netPatches.ApplyFunc(nets.GrpcConnect, func(addr string, _ credentials.TransportCredentials) (*grpc.ClientConn, error) {
 			mockDiscovery := xdstest.NewMockServer(t)
 			return grpc.Dial("buffcon",
 				grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -121,7 +134,7 @@ func TestClientResponseProcess(t *testing.T) {
 		utConfig.Mode = constants.WorkloadMode
 		netPatches := gomonkey.NewPatches()
 		defer netPatches.Reset()
-		netPatches.ApplyFunc(nets.GrpcConnect, func(addr string) (*grpc.ClientConn, error) {
+		netPatches.ApplyFunc(nets.GrpcConnect, func(addr string, _ credentials.TransportCredentials) (*grpc.ClientConn, error) {
 			mockDiscovery := xdstest.NewMockServer(t)
 			return grpc.Dial("buffcon",
 				grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -163,3 +176,219 @@ func TestClientResponseProcess(t *testing.T) {
 		assert.Equal(t, 2, iteration)
 	})
 }
+
+// TestHandleUpstreamClassification checks that handleUpstream drives its
+// reconnect decision off xdserr.Classify: a synthesized codes.Unavailable
+// error should trigger a reconnect and keep the loop going, while a
+// codes.Unauthenticated error should be treated as fatal and stop it
+// without ever attempting to reconnect.
+func TestHandleUpstreamClassification(t *testing.T) {
+	utConfig := bpf.GetConfig()
+	utConfig.Mode = constants.AdsMode
+	bpfConfig = utConfig
+
+	netPatches := gomonkey.NewPatches()
+	defer netPatches.Reset()
+	netPatches.ApplyFunc(nets.GrpcConnect, func(addr string, _ credentials.TransportCredentials) (*grpc.ClientConn, error) {
+		mockDiscovery := xdstest.NewMockServer(t)
+		return grpc.Dial("buffcon",
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithBlock(),
+			grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+				return mockDiscovery.Listener.Dial()
+			}))
+	})
+
+	utClient := NewXdsClient()
+	err := utClient.createGrpcStreamClient()
+	assert.NilError(t, err)
+
+	reconnects := 0
+	reConnectPatches := gomonkey.NewPatches()
+	defer reConnectPatches.Reset()
+	reConnectPatches.ApplyPrivateMethod(reflect.TypeOf(utClient), "createGrpcStreamClient",
+		func(_ *XdsClient) error {
+			reconnects++
+			return nil
+		})
+
+	calls := 0
+	streamPatches := gomonkey.NewPatches()
+	defer streamPatches.Reset()
+	streamPatches.ApplyMethod(reflect.TypeOf(utClient.AdsStream), "HandleAdsStream",
+		func(_ *envoy.AdsStream) error {
+			calls++
+			switch calls {
+			case 1:
+				return status.Error(codes.Unavailable, "server down")
+			default:
+				utClient.cancel()
+				return status.Error(codes.Unauthenticated, "bad cert")
+			}
+		})
+	utClient.handleUpstream(utClient.ctx)
+
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 1, reconnects)
+
+	code, action := xdserr.Classify(status.Error(codes.Unavailable, "server down"))
+	assert.Equal(t, codes.Unavailable, code)
+	assert.Equal(t, xdserr.Retry, action)
+
+	code, action = xdserr.Classify(status.Error(codes.Unauthenticated, "bad cert"))
+	assert.Equal(t, codes.Unauthenticated, code)
+	assert.Equal(t, xdserr.Fatal, action)
+}
+
+// TestKeepaliveReconnect simulates istiod going silent (no TCP close, just
+// no more pings answered) and checks that the xDS client's keepalive
+// enforcement surfaces it as a stream error within the effective ping
+// interval plus Timeout, instead of only noticing minutes later on the next
+// DiscoveryRequest.
+func TestKeepaliveReconnect(t *testing.T) {
+	utConfig := bpf.GetConfig()
+	utConfig.Mode = constants.AdsMode
+	utConfig.XdsKeepaliveInterval = 50 * time.Millisecond
+	utConfig.XdsKeepaliveTimeout = 50 * time.Millisecond
+	bpfConfig = utConfig
+
+	mockDiscovery := xdstest.NewMockServer(t)
+	netPatches := gomonkey.NewPatches()
+	defer netPatches.Reset()
+	netPatches.ApplyFunc(nets.GrpcConnect, func(addr string, _ credentials.TransportCredentials) (*grpc.ClientConn, error) {
+		return grpc.Dial("buffcon",
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithBlock(),
+			grpc.WithKeepaliveParams(keepalive.ClientParameters{
+				Time:                utConfig.XdsKeepaliveInterval,
+				Timeout:             utConfig.XdsKeepaliveTimeout,
+				PermitWithoutStream: true,
+			}),
+			grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+				return mockDiscovery.Listener.Dial()
+			}))
+	})
+
+	utClient := NewXdsClient()
+	utClient.sleep = func(time.Duration) {}
+	utClient.randFloat = func() float64 { return 0.5 }
+	err := utClient.createGrpcStreamClient()
+	assert.NilError(t, err)
+
+	// The server stops answering pings, but the bufconn pipe itself stays
+	// open, so only keepalive enforcement -- not a TCP-level close -- can
+	// detect this.
+	mockDiscovery.DropPings()
+
+	// grpc-go raises any client keepalive Time below 10s up to 10s, so that
+	// is the earliest the first ping can go out on this idle connection.
+	keepaliveInterval := utConfig.XdsKeepaliveInterval
+	if keepaliveInterval < 10*time.Second {
+		keepaliveInterval = 10 * time.Second
+	}
+
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- utClient.AdsStream.HandleAdsStream()
+	}()
+
+	select {
+	case err := <-recvErr:
+		assert.Assert(t, err != nil)
+	case <-time.After(utConfig.XdsKeepaliveTimeout + keepaliveInterval + 5*time.Second):
+		t.Fatal("expected the client to notice the silent server within the ping interval plus Timeout")
+	}
+}
+
+// fakeMultiResolverBuilder stands in for the real staticBuilder nets keeps
+// unexported, so tests can wire up a fake resolver.ClientConn without
+// reaching into the nets package's internals.
+type fakeMultiResolverBuilder struct {
+	scheme string
+	addrs  []string
+	built  chan *nets.StaticResolver
+}
+
+func (b *fakeMultiResolverBuilder) Scheme() string { return b.scheme }
+
+func (b *fakeMultiResolverBuilder) Build(_ resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	r := nets.NewStaticResolver(cc)
+	r.UpdateAddresses(b.addrs)
+	b.built <- r
+	return r, nil
+}
+
+func (b *fakeMultiResolverBuilder) ResolveNow(resolver.ResolveNowOptions) {}
+func (b *fakeMultiResolverBuilder) Close()                                {}
+
+// TestMultiEndpointFailover verifies that once two discovery endpoints are
+// configured, stopping the first leaves the balanced connection Ready
+// through the second, and that this balancer-level failover alone does not
+// replace utClient.AdsStream. handleUpstream is not running here, so the
+// stream error a stopped endpoint causes is not acted on.
+func TestMultiEndpointFailover(t *testing.T) {
+	utConfig := bpf.GetConfig()
+	utConfig.Mode = constants.AdsMode
+	utConfig.DiscoveryAddress = "mock1,mock2"
+	utConfig.XdsStickyPreferred = false
+	bpfConfig = utConfig
+	t.Cleanup(func() {
+		utConfig.DiscoveryAddress = constants.DefaultDiscoveryAddress
+	})
+
+	mock1 := xdstest.NewMockServer(t)
+	mock2 := xdstest.NewMockServer(t)
+
+	netPatches := gomonkey.NewPatches()
+	defer netPatches.Reset()
+	netPatches.ApplyFunc(nets.GrpcConnectMulti, func(scheme string, addresses []string, policy string, _ credentials.TransportCredentials) (*grpc.ClientConn, *nets.StaticResolver, error) {
+		builder := &fakeMultiResolverBuilder{scheme: scheme, addrs: addresses, built: make(chan *nets.StaticResolver, 1)}
+		conn, err := grpc.Dial(scheme+":///xds",
+			grpc.WithResolvers(builder),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, policy)),
+			grpc.WithContextDialer(func(_ context.Context, addr string) (net.Conn, error) {
+				switch addr {
+				case "mock1":
+					return mock1.Listener.Dial()
+				case "mock2":
+					return mock2.Listener.Dial()
+				default:
+					return nil, fmt.Errorf("unknown discovery address %q", addr)
+				}
+			}))
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, <-builder.built, nil
+	})
+
+	utClient := NewXdsClient()
+	utClient.sleep = func(time.Duration) {}
+	utClient.randFloat = func() float64 { return 0.5 }
+	err := utClient.createGrpcStreamClient()
+	assert.NilError(t, err)
+	adsStream := utClient.AdsStream
+	assert.Assert(t, adsStream != nil)
+
+	// Stop the first endpoint; the balancer should keep the connection
+	// Ready through the other one on its own.
+	mock1.GoSilent()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state := utClient.conn.GetState()
+		if state == connectivity.Ready {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection never recovered after killing the first endpoint, last state: %s", state)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		utClient.conn.WaitForStateChange(ctx, state)
+		cancel()
+	}
+
+	// The balancer's failover by itself did not replace the AdsStream.
+	assert.Equal(t, adsStream, utClient.AdsStream)
+}
@@ -0,0 +1,419 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controller
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"gotest.tools/assert"
+
+	"kmesh.net/kmesh/pkg/bpf"
+	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/controller/xdstest"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+// testCA is a minimal self-signed CA used to sign server and client
+// certificates for the mTLS tests below.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kmesh-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NilError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pemBytes() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// issue signs a leaf certificate for dnsName with the given serial, returning
+// both the tls.Certificate form (for a grpc server) and the cert/key PEM
+// bytes (for writing to disk, the way a static-file credential provider
+// would load them).
+func (ca *testCA) issue(t *testing.T, dnsName string, serial int64) (tls.Certificate, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.NilError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NilError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.NilError(t, err)
+
+	return tlsCert, certPEM, keyPEM
+}
+
+// issueSpiffeSVID signs a leaf certificate carrying id as its sole URI SAN,
+// the shape the SPIFFE Workload API hands back in an X509SVID response, and
+// returns its DER chain alongside a DER-encoded PKCS#8 key.
+func (ca *testCA) issueSpiffeSVID(t *testing.T, id spiffeid.ID, serial int64) (certDER, keyDER []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		URIs:         []*url.URL{id.URL()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err = x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.NilError(t, err)
+	keyDER, err = x509.MarshalPKCS8PrivateKey(key)
+	assert.NilError(t, err)
+	return certDER, keyDER
+}
+
+// fakeWorkloadAPI is a minimal SPIFFE Workload API server: it streams
+// whatever X509SVID is currently set, then blocks until setSVID replaces it
+// and streams the new one, the way a real SPIRE agent pushes rotations.
+type fakeWorkloadAPI struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+
+	mu      sync.Mutex
+	svid    *workload.X509SVID
+	changed chan struct{}
+}
+
+func (f *fakeWorkloadAPI) setSVID(svid *workload.X509SVID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.svid = svid
+	if f.changed != nil {
+		close(f.changed)
+	}
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeWorkloadAPI) FetchX509SVID(_ *workload.X509SVIDRequest, stream grpc.ServerStreamingServer[workload.X509SVIDResponse]) error {
+	for {
+		f.mu.Lock()
+		svid, changed := f.svid, f.changed
+		f.mu.Unlock()
+		if svid == nil {
+			return status.Error(codes.Unavailable, "no identity issued yet")
+		}
+		if err := stream.Send(&workload.X509SVIDResponse{Svids: []*workload.X509SVID{svid}}); err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// newFakeWorkloadAPI starts a fakeWorkloadAPI on a unix socket under t's
+// temp dir and registers it to be torn down when the test completes.
+func newFakeWorkloadAPI(t *testing.T) (addr string, api *fakeWorkloadAPI) {
+	t.Helper()
+	sockPath := filepath.Join(t.TempDir(), "wl.sock")
+	lis, err := net.Listen("unix", sockPath)
+	assert.NilError(t, err)
+
+	api = &fakeWorkloadAPI{}
+	server := grpc.NewServer()
+	workload.RegisterSpiffeWorkloadAPIServer(server, api)
+
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	return "unix://" + sockPath, api
+}
+
+// TestSpiffeCredentialRotation verifies mTLS end-to-end for the SPIFFE
+// path: the client fetches its initial SVID from the Workload API and
+// authenticates against a server requiring client certs, then the
+// Workload API issues a new SVID and a fresh reconnect authenticates with
+// it, the same rotate-with-no-reload-step story as the static file path.
+func TestSpiffeCredentialRotation(t *testing.T) {
+	const trustDomain = "cluster.local"
+
+	// The client authorizes the server by SPIFFE ID, so the server needs an
+	// SVID in the trust domain rather than a plain DNS-named certificate.
+	ca := newTestCA(t)
+	serverID := spiffeid.RequireFromString("spiffe://" + trustDomain + "/istiod")
+	serverCertDER, serverKeyDER := ca.issueSpiffeSVID(t, serverID, 100)
+	serverKey, err := x509.ParsePKCS8PrivateKey(serverKeyDER)
+	assert.NilError(t, err)
+	serverCert := tls.Certificate{Certificate: [][]byte{serverCertDER}, PrivateKey: serverKey}
+
+	mockDiscovery := xdstest.NewMockServer(t, xdstest.WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    mustCertPool(t, ca.pemBytes()),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}))
+
+	workloadAddr, workloadAPI := newFakeWorkloadAPI(t)
+	clientID := spiffeid.RequireFromString("spiffe://" + trustDomain + "/kmesh-client")
+
+	certDERv1, keyDERv1 := ca.issueSpiffeSVID(t, clientID, 1)
+	workloadAPI.setSVID(&workload.X509SVID{
+		SpiffeId:    clientID.String(),
+		X509Svid:    certDERv1,
+		X509SvidKey: keyDERv1,
+		Bundle:      ca.cert.Raw,
+	})
+
+	utConfig := bpf.GetConfig()
+	utConfig.Mode = constants.AdsMode
+	utConfig.XdsTLSMode = constants.TLSModeSpiffe
+	utConfig.XdsSpiffeWorkloadAPIAddr = workloadAddr
+	utConfig.XdsSpiffeTrustDomain = trustDomain
+	bpfConfig = utConfig
+	t.Cleanup(func() {
+		utConfig.XdsTLSMode = constants.TLSModeInsecure
+	})
+
+	netPatches := gomonkey.NewPatches()
+	defer netPatches.Reset()
+	netPatches.ApplyFunc(nets.GrpcConnect, func(addr string, creds credentials.TransportCredentials) (*grpc.ClientConn, error) {
+		return grpc.Dial("buffcon",
+			grpc.WithTransportCredentials(creds),
+			grpc.WithBlock(),
+			grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+				return mockDiscovery.Listener.Dial()
+			}))
+	})
+
+	utClient := NewXdsClient()
+	utClient.sleep = func(time.Duration) {}
+	utClient.randFloat = func() float64 { return 0.5 }
+	err = utClient.createGrpcStreamClient()
+	assert.NilError(t, err)
+	t.Cleanup(utClient.Close)
+
+	go func() { _ = utClient.AdsStream.HandleAdsStream() }()
+	waitForPeerCertSerial(t, mockDiscovery, big.NewInt(1))
+
+	// Issue a fresh SVID from the Workload API, then force a fresh dial
+	// the way handleUpstream would after a stream error.
+	certDERv2, keyDERv2 := ca.issueSpiffeSVID(t, clientID, 2)
+	workloadAPI.setSVID(&workload.X509SVID{
+		SpiffeId:    clientID.String(),
+		X509Svid:    certDERv2,
+		X509SvidKey: keyDERv2,
+		Bundle:      ca.cert.Raw,
+	})
+
+	// Wait for the provider's Workload API stream to pick up the new SVID,
+	// so the redial below can't race the push.
+	source := utClient.credProvider.(*SpiffeCredentialProvider).source
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		svid, err := source.GetX509SVID()
+		if err == nil && svid.Certificates[0].SerialNumber.Cmp(big.NewInt(2)) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("spiffe source never picked up the rotated SVID")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.NilError(t, utClient.conn.Close())
+	utClient.conn = nil
+	err = utClient.createGrpcStreamClient()
+	assert.NilError(t, err)
+	go func() { _ = utClient.AdsStream.HandleAdsStream() }()
+
+	waitForPeerCertSerial(t, mockDiscovery, big.NewInt(2))
+}
+
+// TestSpiffeCredentialProviderTimeout verifies that TransportCredentials
+// gives up and returns an error instead of hanging forever when the
+// Workload API never answers -- the bug that would otherwise wedge
+// recoverConnection's whole retry loop (see spiffeSourceTimeout).
+func TestSpiffeCredentialProviderTimeout(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "wl.sock")
+	lis, err := net.Listen("unix", sockPath)
+	assert.NilError(t, err)
+	t.Cleanup(func() { _ = lis.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	p := &SpiffeCredentialProvider{
+		ctx:             ctx,
+		WorkloadAPIAddr: "unix://" + sockPath,
+		TrustDomain:     "cluster.local",
+	}
+
+	restore := spiffeSourceTimeout
+	spiffeSourceTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { spiffeSourceTimeout = restore })
+
+	start := time.Now()
+	_, err = p.TransportCredentials()
+	assert.Assert(t, err != nil)
+	assert.Assert(t, time.Since(start) < 5*time.Second)
+}
+
+// TestStaticTLSCredentialRotation verifies mTLS end-to-end: the client
+// authenticates against a server requiring client certs, then the operator
+// rotates the on-disk cert/key files and a fresh reconnect authenticates
+// with the new certificate without any code-level "reload" step.
+func TestStaticTLSCredentialRotation(t *testing.T) {
+	const serverName = "istiod.test"
+
+	ca := newTestCA(t)
+	serverCert, _, _ := ca.issue(t, serverName, 100)
+
+	mockDiscovery := xdstest.NewMockServer(t, xdstest.WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    mustCertPool(t, ca.pemBytes()),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}))
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	assert.NilError(t, os.WriteFile(caFile, ca.pemBytes(), 0o600))
+
+	_, clientCertV1, clientKeyV1 := ca.issue(t, "kmesh-client", 1)
+	assert.NilError(t, os.WriteFile(certFile, clientCertV1, 0o600))
+	assert.NilError(t, os.WriteFile(keyFile, clientKeyV1, 0o600))
+
+	utConfig := bpf.GetConfig()
+	utConfig.Mode = constants.AdsMode
+	utConfig.XdsTLSMode = constants.TLSModeStatic
+	utConfig.XdsTLSCertFile = certFile
+	utConfig.XdsTLSKeyFile = keyFile
+	utConfig.XdsTLSCAFile = caFile
+	utConfig.XdsTLSServerName = serverName
+	bpfConfig = utConfig
+	t.Cleanup(func() {
+		utConfig.XdsTLSMode = constants.TLSModeInsecure
+	})
+
+	netPatches := gomonkey.NewPatches()
+	defer netPatches.Reset()
+	netPatches.ApplyFunc(nets.GrpcConnect, func(addr string, creds credentials.TransportCredentials) (*grpc.ClientConn, error) {
+		return grpc.Dial("buffcon",
+			grpc.WithTransportCredentials(creds),
+			grpc.WithBlock(),
+			grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+				return mockDiscovery.Listener.Dial()
+			}))
+	})
+
+	utClient := NewXdsClient()
+	utClient.sleep = func(time.Duration) {}
+	utClient.randFloat = func() float64 { return 0.5 }
+	err := utClient.createGrpcStreamClient()
+	assert.NilError(t, err)
+
+	go func() { _ = utClient.AdsStream.HandleAdsStream() }()
+	waitForPeerCertSerial(t, mockDiscovery, big.NewInt(1))
+
+	// Rotate the client cert on disk, then force a fresh dial the way
+	// handleUpstream would after a stream error -- no code change, no
+	// process restart.
+	_, clientCertV2, clientKeyV2 := ca.issue(t, "kmesh-client", 2)
+	assert.NilError(t, os.WriteFile(certFile, clientCertV2, 0o600))
+	assert.NilError(t, os.WriteFile(keyFile, clientKeyV2, 0o600))
+
+	assert.NilError(t, utClient.conn.Close())
+	utClient.conn = nil
+	err = utClient.createGrpcStreamClient()
+	assert.NilError(t, err)
+	go func() { _ = utClient.AdsStream.HandleAdsStream() }()
+
+	waitForPeerCertSerial(t, mockDiscovery, big.NewInt(2))
+}
+
+func waitForPeerCertSerial(t *testing.T, m *xdstest.MockServer, want *big.Int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if serial := m.LastPeerCertSerial(); serial != nil && serial.Cmp(want) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("mock server never observed a client cert with serial %s", want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func mustCertPool(t *testing.T, pemBytes []byte) *x509.CertPool {
+	t.Helper()
+	pool := x509.NewCertPool()
+	assert.Assert(t, pool.AppendCertsFromPEM(pemBytes))
+	return pool
+}
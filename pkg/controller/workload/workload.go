@@ -0,0 +1,70 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package workload drives the workload (ambient/dual-engine) xDS surface,
+// receiving istiod workload API updates. Received responses are not
+// written to Kmesh's bpf maps by this package.
+package workload
+
+import (
+	"context"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+
+	"kmesh.net/kmesh/pkg/logger"
+)
+
+var log = logger.NewLoggerScope("workload")
+
+// WorkloadStream owns the long-lived workload xDS stream.
+type WorkloadStream struct {
+	client discovery.AggregatedDiscoveryServiceClient
+	stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+}
+
+// NewWorkloadStream opens a workload xDS stream on the given connection.
+func NewWorkloadStream(conn *grpc.ClientConn) (*WorkloadStream, error) {
+	client := discovery.NewAggregatedDiscoveryServiceClient(conn)
+	stream, err := client.StreamAggregatedResources(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &WorkloadStream{client: client, stream: stream}, nil
+}
+
+// HandleWorkloadStream blocks receiving DiscoveryResponses and passing them
+// to handleResponse until the stream errors out, e.g. when its connection is
+// closed. The stream is opened with context.Background, so nothing else
+// ends it.
+func (s *WorkloadStream) HandleWorkloadStream() error {
+	for {
+		resp, err := s.stream.Recv()
+		if err != nil {
+			log.Errorf("workload stream recv failed: %v", err)
+			return err
+		}
+		if err := s.handleResponse(resp); err != nil {
+			log.Errorf("failed to apply workload response: %v", err)
+			return err
+		}
+	}
+}
+
+func (s *WorkloadStream) handleResponse(resp *discovery.DiscoveryResponse) error {
+	_ = resp
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package xdserr classifies errors returned by the ADS/workload streams
+// into an action the caller should take, and records metrics about those
+// classifications so reconnect behavior is observable in production.
+package xdserr
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Action describes how the xDS client should react to a stream error.
+type Action int
+
+const (
+	// Retry reconnects immediately.
+	Retry Action = iota
+	// RetryAfterBackoff reconnects, but only after a backoff delay -- the
+	// peer has asked us to slow down (e.g. ResourceExhausted).
+	RetryAfterBackoff
+	// Fatal means retrying will not help; the client should stop.
+	Fatal
+	// RestartStream reopens the ADS/workload stream on the existing
+	// connection instead of tearing down and redialing -- the transport is
+	// fine, only the stream itself needs to be recreated.
+	RestartStream
+)
+
+// String implements fmt.Stringer, and is also used as the "action" metric
+// label.
+func (a Action) String() string {
+	switch a {
+	case Retry:
+		return "retry"
+	case RetryAfterBackoff:
+		return "retry_after_backoff"
+	case Fatal:
+		return "fatal"
+	case RestartStream:
+		return "restart_stream"
+	default:
+		return "unknown"
+	}
+}
+
+// Classify extracts the gRPC status code from err, if any, and maps it to
+// the Action the caller should take. Errors that don't carry a gRPC status
+// (e.g. a plain context.Canceled) are treated as retryable.
+func Classify(err error) (codes.Code, Action) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return codes.Unknown, Retry
+	}
+
+	switch st.Code() {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return st.Code(), Fatal
+	case codes.ResourceExhausted:
+		// The peer is telling us to slow down, not that it's unreachable.
+		return st.Code(), RetryAfterBackoff
+	case codes.Internal:
+		// Usually a one-off protocol hiccup on an otherwise healthy
+		// connection; restarting the stream is cheaper and faster than a
+		// full reconnect.
+		return st.Code(), RestartStream
+	default:
+		return st.Code(), Retry
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdserr
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gotest.tools/assert"
+)
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		name       string
+		err        error
+		wantCode   codes.Code
+		wantAction Action
+	}{
+		{
+			name:       "unavailable is retryable",
+			err:        status.Error(codes.Unavailable, "server down"),
+			wantCode:   codes.Unavailable,
+			wantAction: Retry,
+		},
+		{
+			name:       "unauthenticated is fatal",
+			err:        status.Error(codes.Unauthenticated, "bad cert"),
+			wantCode:   codes.Unauthenticated,
+			wantAction: Fatal,
+		},
+		{
+			name:       "permission denied is fatal",
+			err:        status.Error(codes.PermissionDenied, "not authorized"),
+			wantCode:   codes.PermissionDenied,
+			wantAction: Fatal,
+		},
+		{
+			name:       "resource exhausted backs off",
+			err:        status.Error(codes.ResourceExhausted, "slow down"),
+			wantCode:   codes.ResourceExhausted,
+			wantAction: RetryAfterBackoff,
+		},
+		{
+			name:       "internal restarts the stream",
+			err:        status.Error(codes.Internal, "protocol error"),
+			wantCode:   codes.Internal,
+			wantAction: RestartStream,
+		},
+		{
+			name:       "non-status error is retryable",
+			err:        errors.New("boom"),
+			wantCode:   codes.Unknown,
+			wantAction: Retry,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			code, action := Classify(tc.err)
+			assert.Equal(t, tc.wantCode, code)
+			assert.Equal(t, tc.wantAction, action)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdserr
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+var (
+	streamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kmesh_xds_stream_errors_total",
+		Help: "Count of ADS/workload stream errors by the action taken in response.",
+	}, []string{"stream_type", "grpc_code", "action"})
+
+	reconnectDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kmesh_xds_reconnect_duration_seconds",
+		Help:    "Time taken to re-establish the xDS connection and stream after a retryable error.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"stream_type"})
+)
+
+func init() {
+	prometheus.MustRegister(streamErrorsTotal, reconnectDuration)
+}
+
+// RecordClassification increments the error-classification counter for a
+// stream error seen on streamType ("ads" or "workload").
+func RecordClassification(streamType string, code codes.Code, action Action) {
+	streamErrorsTotal.WithLabelValues(streamType, code.String(), action.String()).Inc()
+}
+
+// ObserveReconnect records how long it took to recover streamType after a
+// retryable error.
+func ObserveReconnect(streamType string, d time.Duration) {
+	reconnectDuration.WithLabelValues(streamType).Observe(d.Seconds())
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package xdstest provides an in-memory ADS server for exercising the xDS
+// client's connection and reconnection logic without a real istiod.
+package xdstest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const bufSize = 1024 * 1024
+
+// MockServer is an in-process ADS server backed by a bufconn listener, so
+// tests can dial it through grpc.WithContextDialer without touching the
+// network.
+type MockServer struct {
+	discovery.UnimplementedAggregatedDiscoveryServiceServer
+
+	Listener   *bufconn.Listener
+	grpcServer *grpc.Server
+	dropPings  *atomic.Bool
+
+	mu           sync.Mutex
+	lastPeerCert *x509.Certificate
+}
+
+// NewMockServer starts a MockServer and registers it to be torn down when
+// the test completes. Pass WithTLS to serve over TLS.
+func NewMockServer(t *testing.T, opts ...ServerOption) *MockServer {
+	t.Helper()
+
+	var serverOpts []grpc.ServerOption
+	for _, opt := range opts {
+		serverOpts = append(serverOpts, opt())
+	}
+
+	m := &MockServer{
+		Listener:   bufconn.Listen(bufSize),
+		grpcServer: grpc.NewServer(serverOpts...),
+		dropPings:  &atomic.Bool{},
+	}
+	discovery.RegisterAggregatedDiscoveryServiceServer(m.grpcServer, m)
+
+	go func() {
+		_ = m.grpcServer.Serve(&pingDroppingListener{Listener: m.Listener, drop: m.dropPings})
+	}()
+	t.Cleanup(func() {
+		m.grpcServer.Stop()
+	})
+
+	return m
+}
+
+// ServerOption customizes the grpc.Server backing a MockServer.
+type ServerOption func() grpc.ServerOption
+
+// WithTLS serves the MockServer over TLS with tlsConfig. Whether a client
+// certificate is required and verified is decided by tlsConfig.ClientAuth.
+func WithTLS(tlsConfig *tls.Config) ServerOption {
+	return func() grpc.ServerOption {
+		return grpc.Creds(credentials.NewTLS(tlsConfig))
+	}
+}
+
+// GoSilent hard-stops the server, immediately closing every open
+// connection and the listener itself. It simulates an istiod endpoint
+// disappearing outright -- use it to drive a balancer failover test, where
+// what matters is that the client notices the endpoint is gone and moves
+// on. It is NOT a simulation of a peer that's merely stopped responding to
+// keepalive pings while the connection stays up; for that, use DropPings.
+func (m *MockServer) GoSilent() {
+	m.grpcServer.Stop()
+}
+
+// DropPings makes the server stop acknowledging HTTP/2 keepalive pings
+// without closing the underlying connection, simulating istiod going
+// unresponsive while the TCP/bufconn pipe itself stays open. Only
+// keepalive enforcement on the client's transport -- not an ordinary
+// connection-closed error -- can detect this.
+func (m *MockServer) DropPings() {
+	m.dropPings.Store(true)
+}
+
+// LastPeerCertSerial returns the serial number of the client certificate
+// presented on the most recent StreamAggregatedResources call, or nil if
+// none has come in yet or the connection wasn't authenticated with mTLS.
+// Tests use this to confirm a reconnect actually picked up rotated cert
+// material instead of reusing a cached handshake.
+func (m *MockServer) LastPeerCertSerial() *big.Int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lastPeerCert == nil {
+		return nil
+	}
+	return m.lastPeerCert.SerialNumber
+}
+
+// StreamAggregatedResources never sends a response: it records the client
+// certificate, if any, and then blocks until the stream's context ends.
+func (m *MockServer) StreamAggregatedResources(stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) > 0 {
+			m.mu.Lock()
+			m.lastPeerCert = tlsInfo.State.PeerCertificates[0]
+			m.mu.Unlock()
+		}
+	}
+	<-stream.Context().Done()
+	return stream.Context().Err()
+}
+
+// pingDroppingListener wraps a net.Listener so every accepted connection's
+// outgoing bytes pass through a pingDroppingConn.
+type pingDroppingListener struct {
+	net.Listener
+	drop *atomic.Bool
+}
+
+func (l *pingDroppingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &pingDroppingConn{Conn: conn, drop: l.drop}, nil
+}
+
+// pingDroppingConn discards outgoing HTTP/2 PING ACK frames while drop is
+// set, without touching anything else written on the connection -- so the
+// peer keeps seeing a live TCP/bufconn pipe, just one that never answers a
+// keepalive ping.
+type pingDroppingConn struct {
+	net.Conn
+	drop *atomic.Bool
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// http2 frame header layout: https://httpwg.org/specs/rfc7540.html#FrameHeader
+const (
+	http2FrameHeaderLen = 9
+	http2FramePing      = 0x6
+	http2FlagAck        = 0x1
+)
+
+func (c *pingDroppingConn) Write(p []byte) (int, error) {
+	if !c.drop.Load() {
+		return c.Conn.Write(p)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf = append(c.buf, p...)
+
+	for len(c.buf) >= http2FrameHeaderLen {
+		length := int(c.buf[0])<<16 | int(c.buf[1])<<8 | int(c.buf[2])
+		frameEnd := http2FrameHeaderLen + length
+		if len(c.buf) < frameEnd {
+			break
+		}
+
+		frameType, flags := c.buf[3], c.buf[4]
+		if frameType != http2FramePing || flags&http2FlagAck == 0 {
+			if _, err := c.Conn.Write(c.buf[:frameEnd]); err != nil {
+				return len(p), err
+			}
+		}
+		c.buf = c.buf[frameEnd:]
+	}
+
+	return len(p), nil
+}
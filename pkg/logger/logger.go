@@ -0,0 +1,29 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package logger provides a thin, scoped wrapper around logrus so every
+// subsystem can tag its lines without wiring up a logger by hand.
+package logger
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// NewLoggerScope returns a logger tagged with the given scope name, e.g.
+// "xds", "bpf", "controller". Fields can be attached via WithField/WithFields.
+func NewLoggerScope(scope string) *logrus.Entry {
+	return logrus.WithField("scope", scope)
+}
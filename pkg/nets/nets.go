@@ -0,0 +1,87 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package nets contains small, dependency-free helpers for setting up
+// network connections used by Kmesh's control plane.
+package nets
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+
+	"kmesh.net/kmesh/pkg/bpf"
+)
+
+func keepaliveParams(cfg *bpf.Config) keepalive.ClientParameters {
+	return keepalive.ClientParameters{
+		Time:                cfg.XdsKeepaliveInterval,
+		Timeout:             cfg.XdsKeepaliveTimeout,
+		PermitWithoutStream: true,
+	}
+}
+
+// GrpcConnect dials the given address using creds and returns a ready-to-use
+// gRPC client connection, or an error if the dial failed.
+//
+// A client-side keepalive ping is always enabled so that half-open
+// connections (NAT timeouts, silent istiod restarts) surface as a gRPC
+// Unavailable error instead of only being noticed the next time a
+// DiscoveryRequest is sent, which can be minutes later.
+func GrpcConnect(addr string, creds credentials.TransportCredentials) (*grpc.ClientConn, error) {
+	cfg := bpf.GetConfig()
+	conn, err := grpc.Dial(addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithBlock(),
+		grpc.WithKeepaliveParams(keepaliveParams(cfg)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// GrpcConnectMulti dials a set of discovery endpoints behind a single
+// ClientConn using creds, with policy ("round_robin" or "pick_first")
+// choosing how the balancer spreads or pins traffic across them. Unlike
+// GrpcConnect it does not block until connected: callers should watch the
+// returned connection's state (conn.GetState/WaitForStateChange) and decide
+// their own retry/backoff behavior, since the balancer already retries
+// individual endpoints on its own.
+//
+// The returned StaticResolver lets the caller push an updated address list
+// (e.g. after re-resolving SRV/DNS records) without redialing.
+func GrpcConnectMulti(scheme string, addresses []string, policy string, creds credentials.TransportCredentials) (*grpc.ClientConn, *StaticResolver, error) {
+	if len(addresses) == 0 {
+		return nil, nil, fmt.Errorf("no discovery addresses configured")
+	}
+
+	builder := &staticBuilder{scheme: scheme, addrs: addresses, built: make(chan *StaticResolver, 1)}
+	cfg := bpf.GetConfig()
+	conn, err := grpc.Dial(scheme+":///xds",
+		grpc.WithResolvers(builder),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithKeepaliveParams(keepaliveParams(cfg)),
+		grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, policy)),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conn, <-builder.built, nil
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nets
+
+import (
+	"google.golang.org/grpc/resolver"
+)
+
+// StaticResolver feeds a fixed, updatable set of addresses to a gRPC
+// ClientConn so a load-balancing policy (round_robin, pick_first, ...) can
+// watch them and react as endpoints come and go, instead of the client
+// being pinned to whatever address it happened to dial first.
+type StaticResolver struct {
+	cc resolver.ClientConn
+}
+
+// NewStaticResolver wraps a resolver.ClientConn so callers building their
+// own resolver.Builder (e.g. tests standing up fake discovery endpoints)
+// can still push address updates through the same StaticResolver API that
+// GrpcConnectMulti uses in production.
+func NewStaticResolver(cc resolver.ClientConn) *StaticResolver {
+	return &StaticResolver{cc: cc}
+}
+
+// UpdateAddresses pushes a new address set to the balancer.
+func (r *StaticResolver) UpdateAddresses(addrs []string) {
+	resAddrs := make([]resolver.Address, 0, len(addrs))
+	for _, addr := range addrs {
+		resAddrs = append(resAddrs, resolver.Address{Addr: addr})
+	}
+	r.cc.UpdateState(resolver.State{Addresses: resAddrs})
+}
+
+// ResolveNow is a no-op: StaticResolver's address set only changes via
+// UpdateAddresses.
+func (r *StaticResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+// Close is a no-op; there is nothing for StaticResolver to release.
+func (r *StaticResolver) Close() {}
+
+// staticBuilder builds a StaticResolver seeded with a fixed address list.
+// It is passed to grpc.Dial via grpc.WithResolvers, which scopes it to a
+// single ClientConn, so unlike resolver.Register it needs no globally
+// unique scheme and can't collide across concurrent XdsClients or tests.
+type staticBuilder struct {
+	scheme string
+	addrs  []string
+	built  chan *StaticResolver
+}
+
+func (b *staticBuilder) Scheme() string { return b.scheme }
+
+func (b *staticBuilder) Build(_ resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	r := NewStaticResolver(cc)
+	r.UpdateAddresses(b.addrs)
+	b.built <- r
+	return r, nil
+}